@@ -0,0 +1,130 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/ipfs"
+	"github.com/opencontainers/go-digest"
+)
+
+// blobByte deterministically derives the byte at a global blob offset, so
+// a correct digest can be computed independently of how the blob is split
+// into ranges.
+func blobByte(off int64) byte {
+	return byte((off*7 + 3) % 251)
+}
+
+func newBlobServer(t *testing.T, size int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		off, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		length, _ := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+		buf := make([]byte, length)
+		for i := range buf {
+			buf[i] = blobByte(off + int64(i))
+		}
+		w.Write(buf)
+	}))
+}
+
+func digestOfRange(off, size int64) digest.Digest {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = blobByte(off + int64(i))
+	}
+	return digest.FromBytes(buf)
+}
+
+func TestFetcherFetchVerifiesFullBlobDigest(t *testing.T) {
+	const size = 64
+	srv := newBlobServer(t, size)
+	defer srv.Close()
+	client := ipfs.NewClient(ipfs.WithBaseURL(srv.URL))
+
+	t.Run("match", func(t *testing.T) {
+		f := &fetcher{client: client, cid: "testcid", size: size, digest: digestOfRange(0, size)}
+		rc, err := f.Fetch(context.Background(), 0, size)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		defer rc.Close()
+		if _, err := io.ReadAll(rc); err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		f := &fetcher{client: client, cid: "testcid", size: size, digest: digest.FromString("not the real content")}
+		rc, err := f.Fetch(context.Background(), 0, size)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		defer rc.Close()
+		if _, err := io.ReadAll(rc); err == nil {
+			t.Fatalf("expected digest mismatch error, got nil")
+		}
+	})
+}
+
+func TestFetcherChunkDigestExactRangeOnly(t *testing.T) {
+	const size = 64
+	const chunkOff, chunkSize = int64(16), int64(16)
+	srv := newBlobServer(t, size)
+	defer srv.Close()
+	client := ipfs.NewClient(ipfs.WithBaseURL(srv.URL))
+
+	f := &fetcher{client: client, cid: "testcid", size: size}
+	f.SetChunkDigests(map[ChunkKey]digest.Digest{
+		{Off: chunkOff, Size: chunkSize}: digestOfRange(chunkOff, chunkSize),
+	})
+
+	t.Run("exact range is verified", func(t *testing.T) {
+		rc, err := f.Fetch(context.Background(), chunkOff, chunkSize)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		defer rc.Close()
+		if _, err := io.ReadAll(rc); err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+	})
+
+	t.Run("sub-range is not checked against the whole-chunk digest", func(t *testing.T) {
+		// A request for fewer bytes than the recorded chunk has no entry in
+		// chunkDigests (the key is the full (off, size) extent), so it must
+		// come back unwrapped rather than fail a bogus comparison against a
+		// digest that was never computed over this exact range.
+		rc, err := f.Fetch(context.Background(), chunkOff, chunkSize/2)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		defer rc.Close()
+		if _, wrapped := rc.(*digestVerifyReader); wrapped {
+			t.Fatalf("sub-range fetch unexpectedly wrapped in a digest-verifying reader")
+		}
+		if _, err := io.ReadAll(rc); err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+	})
+}
@@ -17,102 +17,315 @@
 package ipfs
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
-	"os/exec"
-	"strconv"
-	"strings"
-	"time"
+	"sync"
 
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/ipfs"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-type ResolveHandler struct{}
+// PinMode controls how ResolveHandler pins CIDs for the lifetime of a
+// mounted layer.
+type PinMode int
+
+const (
+	// PinOff never pins; a concurrent IPFS GC can evict blocks of a layer
+	// that is actively being read, same as before pinning existed.
+	PinOff PinMode = iota
+	// PinBestEffort pins on Handle but only logs, rather than fails, if
+	// pinning errors.
+	PinBestEffort
+	// PinRequired fails Handle if the CID cannot be pinned.
+	PinRequired
+)
+
+// ResolveHandler resolves and fetches IPFS-backed layers over HTTP, talking
+// to a Kubo RPC API or HTTP gateway via ipfs.Client.
+type ResolveHandler struct {
+	client    *ipfs.Client
+	pinMode   PinMode
+	cacheDir  string
+	cacheOpts []ipfs.CacheOption
+
+	mu       sync.Mutex
+	pinRefs  map[string]int               // cid -> number of live layers referencing it
+	pinLocks map[string]*refCountedMutex  // cid -> lock (and its waiter count) serializing pin/unpin RPCs for that cid
+
+	cacheOnce sync.Once
+	cache     *ipfs.Cache // shared by every fetcher Handle hands out, so size/LRU accounting spans all resolved layers
+	cacheErr  error
+}
+
+// ResolveHandlerOption configures a ResolveHandler returned by
+// NewResolveHandler.
+type ResolveHandlerOption func(*ResolveHandler)
+
+// WithClient configures the ipfs.Client used to reach the IPFS node. With
+// no opts, it talks to the Kubo RPC API on the local node, matching prior
+// behavior of shelling out to the ipfs CLI.
+func WithClient(opts ...ipfs.ClientOption) ResolveHandlerOption {
+	return func(r *ResolveHandler) { r.client = ipfs.NewClient(opts...) }
+}
+
+// WithPinMode sets how resolved CIDs are pinned. Defaults to PinOff.
+func WithPinMode(pinMode PinMode) ResolveHandlerOption {
+	return func(r *ResolveHandler) { r.pinMode = pinMode }
+}
+
+// WithCache wraps every fetcher this handler hands out in a single shared
+// on-disk, content-addressed cache rooted at dir (see ipfs.Cache). Every
+// layer resolved by this handler shares the same size cap and LRU state,
+// so the cap bounds total usage of dir rather than being reset empty for
+// each resolved layer. Unset by default, meaning no caching.
+func WithCache(dir string, opts ...ipfs.CacheOption) ResolveHandlerOption {
+	return func(r *ResolveHandler) {
+		r.cacheDir = dir
+		r.cacheOpts = opts
+	}
+}
+
+// NewResolveHandler creates a ResolveHandler with opts applied over the
+// defaults (RPC mode against the local Kubo daemon, no pinning, no cache).
+func NewResolveHandler(opts ...ResolveHandlerOption) *ResolveHandler {
+	r := &ResolveHandler{
+		client:  ipfs.NewClient(),
+		pinRefs: make(map[string]int),
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
+}
+
+func (r *ResolveHandler) getClient() *ipfs.Client {
+	if r.client == nil {
+		// Allows the zero value ResolveHandler{} to keep working.
+		return ipfs.NewClient()
+	}
+	return r.client
+}
 
 func (r *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
 	cid, err := ipfs.GetCID(desc)
 	if err != nil {
 		return nil, 0, err
 	}
-	sizeB, err := exec.Command("ipfs", "files", "stat", "--format=<size>", "/ipfs/"+cid).Output()
+	client := r.getClient()
+	size, err := client.Stat(ctx, cid)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, fmt.Errorf("failed to stat %q: %w", cid, err)
+	}
+	if r.pinMode != PinOff {
+		if err := r.pin(ctx, client, cid); err != nil {
+			if r.pinMode == PinRequired {
+				return nil, 0, fmt.Errorf("failed to pin %q: %w", cid, err)
+			}
+			log.G(ctx).WithError(err).Warnf("best-effort pin of %q failed; it may be GC'd while mounted", cid)
+		}
+	}
+	var f remote.Fetcher = &fetcher{client: client, cid: cid, size: size, digest: desc.Digest}
+	if r.cacheDir != "" {
+		cache, err := r.getCache()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to set up cache for %q: %w", cid, err)
+		}
+		f = cache.Wrap(f)
+	}
+	return f, size, nil
+}
+
+// getCache lazily creates the single Cache shared by every fetcher this
+// handler hands out, so that resolving many layers against the same
+// r.cacheDir enforces one combined size cap instead of each layer getting
+// its own cache instance blind to what the others wrote.
+func (r *ResolveHandler) getCache() (*ipfs.Cache, error) {
+	r.cacheOnce.Do(func() {
+		r.cache, r.cacheErr = ipfs.NewCache(r.cacheDir, r.cacheOpts...)
+	})
+	return r.cache, r.cacheErr
+}
+
+// refCountedMutex is a *sync.Mutex plus a count of callers that currently
+// hold a reference to it (obtained from ResolveHandler.pinLocks but not yet
+// returned via unlockFor). Tracking waiters lets lockFor/unlockFor safely
+// garbage-collect the map entry for a CID that is no longer referenced by
+// anyone, without a race where the entry is deleted out from under a
+// caller that is still about to lock it.
+type refCountedMutex struct {
+	mu      sync.Mutex
+	waiters int
+}
+
+// lockFor returns the refCountedMutex serializing pin/unpin RPCs for cid,
+// creating it on first use and recording the caller as a waiter on it.
+// Callers must pair this with a deferred call to unlockFor(cid, l).
+// Holding the returned mutex across the whole pin-or-unpin decision (not
+// just the refcount bookkeeping) means a second concurrent caller for the
+// same not-yet-pinned CID waits on the real RPC result instead of racing
+// ahead on the assumption that some other call already pinned it.
+func (r *ResolveHandler) lockFor(cid string) *refCountedMutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pinLocks == nil {
+		r.pinLocks = make(map[string]*refCountedMutex)
+	}
+	l, ok := r.pinLocks[cid]
+	if !ok {
+		l = &refCountedMutex{}
+		r.pinLocks[cid] = l
+	}
+	l.waiters++
+	return l
+}
+
+// unlockFor releases this caller's reference to l, obtained from lockFor,
+// and removes cid's map entry once no other caller still references it.
+// It is safe to delete here: the entry's waiters count can only reach zero
+// while holding r.mu, so no concurrent lockFor call can be in the process
+// of handing out this same instance without having already incremented it.
+func (r *ResolveHandler) unlockFor(cid string, l *refCountedMutex) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l.waiters--
+	if l.waiters == 0 {
+		delete(r.pinLocks, cid)
+	}
+}
+
+// pin pins cid, tracking how many live layers reference it so that
+// Release only unpins once the last referencing layer is gone.
+func (r *ResolveHandler) pin(ctx context.Context, client *ipfs.Client, cid string) error {
+	l := r.lockFor(cid)
+	defer r.unlockFor(cid, l)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.mu.Lock()
+	if r.pinRefs == nil {
+		r.pinRefs = make(map[string]int)
+	}
+	alreadyPinned := r.pinRefs[cid] > 0
+	r.mu.Unlock()
+
+	if !alreadyPinned {
+		if err := client.Pin(ctx, cid); err != nil {
+			return err
+		}
 	}
-	size, err := strconv.ParseInt(strings.TrimSuffix(string(sizeB), "\n"), 10, 64)
+	r.mu.Lock()
+	r.pinRefs[cid]++
+	r.mu.Unlock()
+	return nil
+}
+
+// Release drops this handler's pin on the layer described by desc, issuing
+// a pin rm once no other mounted layer still references the same CID. It
+// should be wired into the snapshotter's layer lifecycle so it runs when a
+// layer is no longer referenced. Release is a no-op if pinning is off or
+// the CID was never successfully pinned.
+func (r *ResolveHandler) Release(ctx context.Context, desc ocispec.Descriptor) error {
+	if r.pinMode == PinOff {
+		return nil
+	}
+	cid, err := ipfs.GetCID(desc)
 	if err != nil {
-		return nil, 0, err
+		return err
+	}
+
+	l := r.lockFor(cid)
+	defer r.unlockFor(cid, l)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.mu.Lock()
+	if r.pinRefs[cid] == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	r.pinRefs[cid]--
+	last := r.pinRefs[cid] == 0
+	if last {
+		delete(r.pinRefs, cid)
 	}
-	return &fetcher{cid: cid, size: size}, size, nil
+	r.mu.Unlock()
+	if !last {
+		return nil
+	}
+	return r.getClient().Unpin(ctx, cid)
 }
 
 type fetcher struct {
-	cid  string
-	size int64
+	client *ipfs.Client
+	cid    string
+	size   int64
+
+	// digest is the digest the full blob (off == 0, size == f.size) must
+	// match, taken from the descriptor's Digest field at Handle time.
+	digest digest.Digest
+
+	mu           sync.Mutex
+	chunkDigests map[ChunkKey]digest.Digest // (offset, length) of a whole TOC chunk -> its expected digest
+}
+
+// ChunkKey identifies a chunk recorded in the estargz TOC by its full
+// extent, not just its start offset: a request for fewer bytes than the
+// whole chunk (e.g. off==chunk start but size<chunk length) is a different,
+// unverifiable range and must not be checked against the whole-chunk digest.
+type ChunkKey struct {
+	Off, Size int64
+}
+
+// SetChunkDigests records the per-chunk digests from the layer's estargz
+// TOC, keyed by each chunk's (offset, length), so that subsequent
+// partial-range fetches can be verified against them. The TOC is not
+// available to ResolveHandler.Handle, and nothing in this repository calls
+// SetChunkDigests, so until a caller does, only full-blob fetches are
+// verified.
+func (f *fetcher) SetChunkDigests(chunkDigests map[ChunkKey]digest.Digest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chunkDigests = chunkDigests
+}
+
+// chunkDigestFor returns the expected digest for a fetch of exactly
+// [off, off+size), if that exact range is a whole chunk recorded in the
+// TOC. A sub-range of a recorded chunk intentionally does not match, since
+// hashing only part of the chunk's bytes can never equal the whole-chunk
+// digest.
+func (f *fetcher) chunkDigestFor(off, size int64) (digest.Digest, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.chunkDigests[ChunkKey{off, size}]
+	return d, ok
 }
 
 func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
 	if off > f.size {
 		return nil, fmt.Errorf("offset is larger than the size of the blob %d(offset) > %d(blob size)", off, f.size)
 	}
-	pr, pw := io.Pipe()
-	go func() {
-		maxretry := 100
-		curoff := off
-		for i := 0; ; i++ {
-			cont, err := func() (cont bool, err error) { // defer scope
-				cmd := exec.Command("ipfs", "cat", fmt.Sprintf("--offset=%d", curoff), fmt.Sprintf("--length=%d", size), f.cid)
-				stderrbuf := new(bytes.Buffer)
-				cmd.Stderr = stderrbuf
-				stdout, err := cmd.StdoutPipe()
-				if err != nil {
-					return false, err
-				}
-				if err := cmd.Start(); err != nil {
-					return false, err
-				}
-				defer func() {
-					go func() {
-						// fully read until EOF
-						io.Copy(io.Discard, stdout)
-						cmd.Wait()
-					}()
-				}()
-				if n, err := io.CopyN(pw, stdout, size); err != nil {
-					sb, _ := io.ReadAll(stderrbuf)
-					if i < maxretry && strings.Contains(string(sb), "someone else has the lock") {
-						log.G(ctx).WithError(err).WithField("stderr", string(sb)).Debugf("retrying copy %q(offset:%d,length:%d,actuallength:%d,retry:%d/%d)", f.cid, off, size, n, i, maxretry)
-						// we need to retry until we can get the lock
-						time.Sleep(time.Second)
-						curoff += n
-						return true, nil
-					}
-					log.G(ctx).WithError(err).WithField("stderr", string(sb)).Debugf("failed to copy %q(offset:%d,length:%d,actuallength:%d,retry:%d/%d)", f.cid, off, size, n, i, maxretry)
-					return false, err
-				}
-				return false, nil
-			}()
-			if err != nil {
-				pw.CloseWithError(err)
-				return
-			}
-			if cont {
-				continue
-			}
-			break
-		}
-		pw.Close()
-	}()
-	return pr, nil
+	rc, err := f.client.Get(ctx, f.cid, off, size)
+	if err != nil {
+		return nil, err
+	}
+	if off == 0 && size == f.size && f.digest != "" {
+		return newDigestVerifyReader(rc, f.digest), nil
+	}
+	if d, ok := f.chunkDigestFor(off, size); ok {
+		return newDigestVerifyReader(rc, d), nil
+	}
+	return rc, nil
 }
 
 func (f *fetcher) Check() error {
-	return exec.Command("ipfs", "files", "stat", "/ipfs/"+f.cid).Run()
+	_, err := f.client.Stat(context.Background(), f.cid)
+	return err
 }
 
 func (f *fetcher) GenID(off int64, size int64) string {
@@ -120,9 +333,34 @@ func (f *fetcher) GenID(off int64, size int64) string {
 	return fmt.Sprintf("%x", sum)
 }
 
-type readCloser struct {
-	io.Reader
-	closeFunc func() error
+// digestVerifyReader hashes bytes as they are read and, once the
+// underlying reader is exhausted, checks the running digest against
+// expected. A mismatch is surfaced as the error from the final Read call
+// instead of io.EOF, so a caller that only checks for a nil error on a
+// short read cannot be fooled into accepting truncated or tampered data.
+type digestVerifyReader struct {
+	rc       io.ReadCloser
+	expected digest.Digest
+	hasher   hash.Hash
+}
+
+func newDigestVerifyReader(rc io.ReadCloser, expected digest.Digest) io.ReadCloser {
+	return &digestVerifyReader{rc: rc, expected: expected, hasher: expected.Algorithm().Hash().New()}
 }
 
-func (r *readCloser) Close() error { return r.closeFunc() }
+func (d *digestVerifyReader) Read(p []byte) (int, error) {
+	n, err := d.rc.Read(p)
+	if n > 0 {
+		d.hasher.Write(p[:n])
+	}
+	if err == io.EOF {
+		if got := digest.NewDigest(d.expected.Algorithm(), d.hasher); got != d.expected {
+			return n, fmt.Errorf("digest mismatch: got %s, expected %s", got, d.expected)
+		}
+	}
+	return n, err
+}
+
+func (d *digestVerifyReader) Close() error {
+	return d.rc.Close()
+}
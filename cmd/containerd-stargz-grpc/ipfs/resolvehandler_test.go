@@ -0,0 +1,125 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/ipfs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func descForCID(cid string) ocispec.Descriptor {
+	return ocispec.Descriptor{URLs: []string{"ipfs://" + cid}}
+}
+
+func TestResolveHandlerPinRequiredFailureDistinctFromFetchFailure(t *testing.T) {
+	t.Run("stat failure", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "not found", http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+		r := NewResolveHandler(WithClient(ipfs.WithBaseURL(srv.URL)), WithPinMode(PinRequired))
+
+		_, _, err := r.Handle(context.Background(), descForCID("cid1"))
+		if err == nil || !strings.Contains(err.Error(), "failed to stat") {
+			t.Fatalf("Handle error = %v, want a \"failed to stat\" error", err)
+		}
+	})
+
+	t.Run("pin failure", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.Contains(r.URL.Path, "/files/stat"):
+				w.Write([]byte(`{"Size": 64}`))
+			case strings.Contains(r.URL.Path, "/pin/add"):
+				http.Error(w, "pin service unavailable", http.StatusInternalServerError)
+			}
+		}))
+		defer srv.Close()
+		r := NewResolveHandler(WithClient(ipfs.WithBaseURL(srv.URL)), WithPinMode(PinRequired))
+
+		_, _, err := r.Handle(context.Background(), descForCID("cid1"))
+		if err == nil || !strings.Contains(err.Error(), "failed to pin") {
+			t.Fatalf("Handle error = %v, want a \"failed to pin\" error", err)
+		}
+		if strings.Contains(err.Error(), "failed to stat") {
+			t.Fatalf("pin failure should not be reported as a stat failure: %v", err)
+		}
+	})
+}
+
+func TestResolveHandlerPinReleaseConcurrentSettlesCorrectly(t *testing.T) {
+	const cid = "testcid"
+	var pinCalls, unpinCalls int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/files/stat"):
+			w.Write([]byte(`{"Size": 64}`))
+		case strings.Contains(r.URL.Path, "/pin/add"):
+			atomic.AddInt64(&pinCalls, 1)
+			w.WriteHeader(http.StatusOK)
+		case strings.Contains(r.URL.Path, "/pin/rm"):
+			atomic.AddInt64(&unpinCalls, 1)
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewResolveHandler(WithClient(ipfs.WithBaseURL(srv.URL)), WithPinMode(PinRequired))
+	client := r.getClient()
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			if err := r.pin(context.Background(), client, cid); err != nil {
+				t.Errorf("pin: %v", err)
+				return
+			}
+			if err := r.Release(context.Background(), descForCID(cid)); err != nil {
+				t.Errorf("Release: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	refs := r.pinRefs[cid]
+	_, lockLeftover := r.pinLocks[cid]
+	r.mu.Unlock()
+	if refs != 0 {
+		t.Fatalf("pinRefs[cid] = %d after all pin/Release pairs completed, want 0", refs)
+	}
+	if lockLeftover {
+		t.Fatalf("pinLocks[cid] still present after the last reference was released")
+	}
+	if got := atomic.LoadInt64(&pinCalls); got != atomic.LoadInt64(&unpinCalls) {
+		t.Fatalf("pin/unpin RPC calls = %d/%d, want equal (every pin must eventually be released)", got, unpinCalls)
+	}
+	if atomic.LoadInt64(&pinCalls) == 0 {
+		t.Fatalf("expected at least one pin RPC call")
+	}
+}
@@ -0,0 +1,292 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+)
+
+// CacheMetrics reports usage of a Cache. All fields are cumulative counters
+// safe for concurrent reads via the atomic package.
+type CacheMetrics struct {
+	Hits        int64
+	Misses      int64
+	BytesServed int64
+}
+
+// CacheOption configures a Cache returned by NewCache.
+type CacheOption func(*Cache)
+
+// WithCacheSizeLimit caps the on-disk cache at limit bytes, evicting the
+// least-recently-used entries once exceeded. A limit of 0 means unbounded.
+func WithCacheSizeLimit(limit int64) CacheOption {
+	return func(c *Cache) { c.sizeLimit = limit }
+}
+
+const tmpInfix = ".tmp-"
+
+// Cache is a persistent, content-addressed cache directory shared by every
+// fetcher wrapped with Wrap. Since CIDs are immutable, a (cid, offset,
+// length) range identified by GenID never needs to be revalidated once
+// cached. Size accounting and LRU eviction are tracked here rather than per
+// fetcher, so resolving N different layers against the same cache
+// directory correctly enforces one shared size cap instead of N independent
+// ones that are each blind to what the others wrote.
+type Cache struct {
+	dir       string
+	sizeLimit int64
+
+	mu      sync.Mutex
+	lru     []string // least-recently-used first
+	metrics CacheMetrics
+}
+
+// NewCache opens (creating if necessary) a cache directory at dir and seeds
+// its LRU accounting from whatever entries are already on disk — left over
+// from other fetchers sharing this Cache, or from a prior process's
+// lifetime — ordered oldest-modified first. Leftover temp files from an
+// interrupted write are removed.
+func NewCache(dir string, opts ...CacheOption) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache dir %q: %w", dir, err)
+	}
+	c := &Cache{dir: dir}
+	for _, o := range opts {
+		o(c)
+	}
+	if err := c.seed(); err != nil {
+		return nil, fmt.Errorf("failed to seed cache from %q: %w", dir, err)
+	}
+	return c, nil
+}
+
+func (c *Cache) seed() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	type seedEntry struct {
+		id      string
+		modTime int64
+	}
+	var seeded []seedEntry
+	for _, e := range entries {
+		if e.IsDir() || strings.Contains(e.Name(), tmpInfix) {
+			if strings.Contains(e.Name(), tmpInfix) {
+				os.Remove(filepath.Join(c.dir, e.Name())) // leftover from an interrupted write
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		seeded = append(seeded, seedEntry{id: e.Name(), modTime: info.ModTime().UnixNano()})
+	}
+	sort.Slice(seeded, func(i, j int) bool { return seeded[i].modTime < seeded[j].modTime })
+	c.lru = make([]string, len(seeded))
+	for i, e := range seeded {
+		c.lru[i] = e.id
+	}
+	return nil
+}
+
+// Metrics returns a snapshot of this cache's hit/miss/byte counters.
+func (c *Cache) Metrics() CacheMetrics {
+	return CacheMetrics{
+		Hits:        atomic.LoadInt64(&c.metrics.Hits),
+		Misses:      atomic.LoadInt64(&c.metrics.Misses),
+		BytesServed: atomic.LoadInt64(&c.metrics.BytesServed),
+	}
+}
+
+// Wrap returns a remote.Fetcher that serves (cid, off, size) ranges out of
+// this Cache, falling back to base and teeing the result into the cache on
+// miss. Every fetcher Wrap'd from the same Cache shares its size cap and
+// LRU state, so eviction accounts for bytes written by all of them.
+func (c *Cache) Wrap(base remote.Fetcher) remote.Fetcher {
+	return &cachedFetcher{cache: c, base: base}
+}
+
+func (c *Cache) path(id string) string {
+	return filepath.Join(c.dir, id)
+}
+
+// NewCachedFetcher is a convenience for the common case of one base fetcher
+// backed by its own cache directory; it is equivalent to
+// NewCache(dir, opts...) followed by Wrap(base). Callers that resolve many
+// fetchers against the same directory (e.g. one per mounted layer) should
+// create a single Cache with NewCache and reuse Wrap instead, so size
+// accounting is shared rather than reset per fetcher.
+func NewCachedFetcher(base remote.Fetcher, dir string, opts ...CacheOption) (remote.Fetcher, error) {
+	c, err := NewCache(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.Wrap(base), nil
+}
+
+type cachedFetcher struct {
+	cache *Cache
+	base  remote.Fetcher
+}
+
+func (f *cachedFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	c := f.cache
+	id := f.base.GenID(off, size)
+	if rc, ok := c.readCache(ctx, id); ok {
+		atomic.AddInt64(&c.metrics.Hits, 1)
+		atomic.AddInt64(&c.metrics.BytesServed, size)
+		return rc, nil
+	}
+	atomic.AddInt64(&c.metrics.Misses, 1)
+	rc, err := f.base.Fetch(ctx, off, size)
+	if err != nil {
+		return nil, err
+	}
+	return c.teeToCache(ctx, id, rc), nil
+}
+
+func (c *Cache) readCache(ctx context.Context, id string) (io.ReadCloser, bool) {
+	file, err := os.Open(c.path(id))
+	if err != nil {
+		return nil, false
+	}
+	c.touch(id)
+	return file, true
+}
+
+// teeToCache streams rc through to the caller while writing a copy to a
+// temp file that is atomically renamed into place on success. Fetch errors
+// or early reader closes simply discard the partial temp file, leaving the
+// cache as if the fetch had never happened.
+func (c *Cache) teeToCache(ctx context.Context, id string, rc io.ReadCloser) io.ReadCloser {
+	tmp, err := os.CreateTemp(c.dir, id+tmpInfix+"*")
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to create cache temp file for %q, serving uncached", id)
+		return rc
+	}
+	return &teeReadCloser{
+		src: rc,
+		tee: tmp,
+		onComplete: func(ok bool) {
+			if !ok {
+				os.Remove(tmp.Name())
+				return
+			}
+			if err := os.Rename(tmp.Name(), c.path(id)); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to commit cache entry %q", id)
+				os.Remove(tmp.Name())
+				return
+			}
+			c.touch(id)
+			c.evictIfNeeded(ctx)
+		},
+	}
+}
+
+func (c *Cache) touch(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range c.lru {
+		if v == id {
+			c.lru = append(c.lru[:i], c.lru[i+1:]...)
+			break
+		}
+	}
+	c.lru = append(c.lru, id)
+}
+
+func (c *Cache) evictIfNeeded(ctx context.Context) {
+	if c.sizeLimit <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total int64
+	sizes := make(map[string]int64, len(c.lru))
+	for _, id := range c.lru {
+		if fi, err := os.Stat(c.path(id)); err == nil {
+			sizes[id] = fi.Size()
+			total += fi.Size()
+		}
+	}
+	for total > c.sizeLimit && len(c.lru) > 0 {
+		victim := c.lru[0]
+		c.lru = c.lru[1:]
+		if err := os.Remove(c.path(victim)); err == nil {
+			total -= sizes[victim]
+		}
+	}
+}
+
+func (f *cachedFetcher) Check() error {
+	return f.base.Check()
+}
+
+func (f *cachedFetcher) GenID(off int64, size int64) string {
+	return f.base.GenID(off, size)
+}
+
+// teeReadCloser copies everything read from src into tee, committing the
+// cache entry via onComplete(true) only once src is read to EOF, and
+// discarding the partial write via onComplete(false) on any error or early
+// close.
+type teeReadCloser struct {
+	src        io.ReadCloser
+	tee        *os.File
+	onComplete func(ok bool)
+	done       bool
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.src.Read(p)
+	if n > 0 {
+		if _, werr := t.tee.Write(p[:n]); werr != nil && !t.done {
+			t.done = true
+			t.onComplete(false)
+		}
+	}
+	if err == io.EOF && !t.done {
+		t.done = true
+		t.onComplete(true)
+	} else if err != nil && err != io.EOF && !t.done {
+		t.done = true
+		t.onComplete(false)
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	if !t.done {
+		t.done = true
+		t.onComplete(false)
+	}
+	t.tee.Close()
+	return t.src.Close()
+}
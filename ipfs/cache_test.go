@@ -0,0 +1,272 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+)
+
+// countingFetcher is a remote.Fetcher whose Fetch returns deterministic
+// content for (off, size) and counts how many times it was actually
+// called, so tests can assert the cache avoided calling through.
+type countingFetcher struct {
+	calls int64
+}
+
+func (f *countingFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	atomic.AddInt64(&f.calls, 1)
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte((off + int64(i)) % 251)
+	}
+	return io.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (f *countingFetcher) Check() error { return nil }
+
+func (f *countingFetcher) GenID(off int64, size int64) string {
+	return fmt.Sprintf("%d-%d", off, size)
+}
+
+func TestCachedFetcherHitsAndMisses(t *testing.T) {
+	dir := t.TempDir()
+	base := &countingFetcher{}
+	f, err := NewCachedFetcher(base, dir)
+	if err != nil {
+		t.Fatalf("NewCachedFetcher: %v", err)
+	}
+	cf := f.(*cachedFetcher)
+
+	read := func(off, size int64) []byte {
+		rc, err := f.Fetch(context.Background(), off, size)
+		if err != nil {
+			t.Fatalf("Fetch(%d,%d): %v", off, size, err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return b
+	}
+
+	first := read(0, 32)
+	if base.calls != 1 {
+		t.Fatalf("calls after first read = %d, want 1", base.calls)
+	}
+	if m := cf.cache.Metrics(); m.Misses != 1 || m.Hits != 0 {
+		t.Fatalf("metrics after miss = %+v", m)
+	}
+
+	second := read(0, 32)
+	if base.calls != 1 {
+		t.Fatalf("calls after repeat read = %d, want 1 (should be served from cache)", base.calls)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("cached read returned different bytes than original fetch")
+	}
+	if m := cf.cache.Metrics(); m.Hits != 1 || m.BytesServed != 32 {
+		t.Fatalf("metrics after hit = %+v", m)
+	}
+
+	read(32, 32)
+	if base.calls != 2 {
+		t.Fatalf("calls after distinct range = %d, want 2", base.calls)
+	}
+}
+
+func TestCachedFetcherEvictsLRUUnderSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	base := &countingFetcher{}
+	f, err := NewCachedFetcher(base, dir, WithCacheSizeLimit(48))
+	if err != nil {
+		t.Fatalf("NewCachedFetcher: %v", err)
+	}
+
+	fetch := func(off, size int64) {
+		rc, err := f.Fetch(context.Background(), off, size)
+		if err != nil {
+			t.Fatalf("Fetch(%d,%d): %v", off, size, err)
+		}
+		io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+
+	fetch(0, 32)  // id "0-32", 32 bytes on disk
+	fetch(32, 32) // id "32-32", pushes total to 64 > 48, evicts "0-32"
+
+	cf := f.(*cachedFetcher)
+	if _, err := os.Stat(cf.cache.path(base.GenID(0, 32))); !os.IsNotExist(err) {
+		t.Fatalf("expected oldest entry to be evicted, stat err = %v", err)
+	}
+	if _, err := os.Stat(cf.cache.path(base.GenID(32, 32))); err != nil {
+		t.Fatalf("expected most recently written entry to survive: %v", err)
+	}
+
+	// Re-fetching the evicted range must miss and go to base again.
+	callsBefore := base.calls
+	fetch(0, 32)
+	if base.calls != callsBefore+1 {
+		t.Fatalf("calls after re-fetching evicted range = %d, want %d", base.calls, callsBefore+1)
+	}
+}
+
+func TestCachedFetcherDiscardsPartialWriteOnError(t *testing.T) {
+	dir := t.TempDir()
+	base := &erroringFetcher{failAfter: 4}
+	f, err := NewCachedFetcher(base, dir)
+	if err != nil {
+		t.Fatalf("NewCachedFetcher: %v", err)
+	}
+
+	rc, err := f.Fetch(context.Background(), 0, 16)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if _, err := io.ReadAll(rc); err == nil {
+		t.Fatalf("expected read error from underlying fetcher, got nil")
+	}
+	rc.Close()
+
+	cf := f.(*cachedFetcher)
+	if _, err := os.Stat(cf.cache.path(base.GenID(0, 16))); !os.IsNotExist(err) {
+		t.Fatalf("partial cache entry should not have been committed, stat err = %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no leftover temp files in cache dir, found %v", entries)
+	}
+}
+
+// TestCacheSharedAcrossWrapEnforcesOneSizeLimit regression-tests the bug
+// where ResolveHandler.Handle built a brand-new cachedFetcher (and thus a
+// fresh, empty LRU) per resolved layer: two fetchers sharing a directory
+// but not a Cache would each stay blind to what the other wrote, so the
+// size cap never actually capped combined disk usage. Wrapping two
+// distinct base fetchers from the same *Cache must enforce one shared cap.
+func TestCacheSharedAcrossWrapEnforcesOneSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCache(dir, WithCacheSizeLimit(48))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	// Two different "layers", as ResolveHandler.Handle would construct per
+	// resolved descriptor, sharing the one Cache via Wrap.
+	baseA := &countingFetcher{}
+	baseB := &countingFetcher{}
+	fA := cache.Wrap(baseA)
+	fB := cache.Wrap(baseB)
+
+	fetch := func(f remote.Fetcher, off, size int64) {
+		rc, err := f.Fetch(context.Background(), off, size)
+		if err != nil {
+			t.Fatalf("Fetch(%d,%d): %v", off, size, err)
+		}
+		io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+
+	fetch(fA, 0, 32)  // layer A writes 32 bytes
+	fetch(fB, 32, 32) // layer B writes 32 bytes; shared total 64 > 48, must evict A's entry
+
+	if _, err := os.Stat(cache.path(baseA.GenID(0, 32))); !os.IsNotExist(err) {
+		t.Fatalf("expected layer A's entry to be evicted once the shared cap was exceeded by layer B, stat err = %v", err)
+	}
+	if _, err := os.Stat(cache.path(baseB.GenID(32, 32))); err != nil {
+		t.Fatalf("expected layer B's entry to survive: %v", err)
+	}
+}
+
+// TestNewCacheSeedsFromExistingDirectory regression-tests that a fresh
+// Cache opened on a directory already holding entries (e.g. a restarted
+// process, or another Cache instance that previously used the same dir)
+// accounts for that pre-existing usage instead of starting from zero and
+// letting total disk usage grow unbounded across restarts.
+func TestNewCacheSeedsFromExistingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	base := &countingFetcher{}
+
+	first, err := NewCache(dir, WithCacheSizeLimit(48))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	fetch := func(f remote.Fetcher, off, size int64) {
+		rc, err := f.Fetch(context.Background(), off, size)
+		if err != nil {
+			t.Fatalf("Fetch(%d,%d): %v", off, size, err)
+		}
+		io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+	fetch(first.Wrap(base), 0, 32) // 32 bytes already on disk before `second` is ever created
+
+	second, err := NewCache(dir, WithCacheSizeLimit(48))
+	if err != nil {
+		t.Fatalf("NewCache (second instance, same dir): %v", err)
+	}
+	fetch(second.Wrap(base), 32, 32) // pushes shared total to 64 > 48
+
+	if _, err := os.Stat(second.path(base.GenID(0, 32))); !os.IsNotExist(err) {
+		t.Fatalf("expected pre-existing entry to be counted and evicted by the new Cache instance, stat err = %v", err)
+	}
+}
+
+// erroringFetcher returns a reader that errors partway through, to
+// exercise the cache's partial-write cleanup path.
+type erroringFetcher struct {
+	failAfter int
+}
+
+func (f *erroringFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	return &failingReader{remaining: f.failAfter}, nil
+}
+
+func (f *erroringFetcher) Check() error { return nil }
+
+func (f *erroringFetcher) GenID(off int64, size int64) string {
+	return fmt.Sprintf("%d-%d", off, size)
+}
+
+type failingReader struct {
+	remaining int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, fmt.Errorf("simulated fetch error")
+	}
+	n := len(p)
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.remaining -= n
+	return n, nil
+}
+
+func (r *failingReader) Close() error { return nil }
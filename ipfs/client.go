@@ -0,0 +1,315 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ipfs provides a client for reading blobs out of an IPFS node over
+// HTTP, either through the Kubo RPC API or through an HTTP gateway. It also
+// provides helpers for extracting the CID that an OCI descriptor refers to.
+package ipfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// DefaultRPCBaseURL is the default address of the Kubo RPC API on a
+	// locally running node.
+	DefaultRPCBaseURL = "http://127.0.0.1:5001"
+
+	// DefaultGatewayBaseURL is the default address of the local Kubo HTTP
+	// gateway.
+	DefaultGatewayBaseURL = "http://127.0.0.1:8080"
+
+	cidURLScheme = "ipfs://"
+)
+
+// Mode selects which IPFS HTTP API a Client talks to.
+type Mode int
+
+const (
+	// ModeRPC talks to the Kubo RPC API (/api/v0/...). This is the default
+	// and is the only mode in which Pin and Unpin work.
+	ModeRPC Mode = iota
+
+	// ModeGateway talks to a plain HTTP gateway (GET /ipfs/{cid}), using
+	// Range requests for partial reads and a HEAD request for size.
+	ModeGateway
+)
+
+// Client reads blobs from an IPFS node over HTTP.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	mode       Mode
+	header     http.Header
+
+	parallelChunkSize   int64
+	parallelConcurrency int
+}
+
+// ClientOption configures a Client returned by NewClient.
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the *http.Client used for all requests. Defaults to
+// http.DefaultClient.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithBaseURL overrides the address of the IPFS node, e.g.
+// "http://127.0.0.1:5001" for the RPC API or "https://ipfs.io" for a
+// gateway. Must be paired with WithMode when switching away from the
+// default RPC mode.
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) { c.baseURL = strings.TrimSuffix(baseURL, "/") }
+}
+
+// WithMode selects the RPC or gateway API. Defaults to ModeRPC.
+func WithMode(mode Mode) ClientOption {
+	return func(c *Client) { c.mode = mode }
+}
+
+// WithHeader adds a header (e.g. Authorization) sent with every request
+// issued by the Client.
+func WithHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		if c.header == nil {
+			c.header = make(http.Header)
+		}
+		c.header.Add(key, value)
+	}
+}
+
+// WithParallelFetch enables splitting range reads larger than chunkSize
+// into sub-ranges of chunkSize bytes, fetched concurrently (bounded by
+// concurrency) and reassembled in order. Ranges no larger than chunkSize
+// are fetched as a single request as before.
+func WithParallelFetch(chunkSize int64, concurrency int) ClientOption {
+	return func(c *Client) {
+		c.parallelChunkSize = chunkSize
+		c.parallelConcurrency = concurrency
+	}
+}
+
+// NewClient creates a Client configured to talk to the local Kubo RPC API
+// unless overridden by opts.
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{
+		httpClient: http.DefaultClient,
+		baseURL:    DefaultRPCBaseURL,
+		mode:       ModeRPC,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Stat returns the size in bytes of the blob identified by cid.
+func (c *Client) Stat(ctx context.Context, cid string) (int64, error) {
+	switch c.mode {
+	case ModeGateway:
+		return c.statGateway(ctx, cid)
+	default:
+		return c.statRPC(ctx, cid)
+	}
+}
+
+func (c *Client) statRPC(ctx context.Context, cid string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v0/files/stat", nil)
+	if err != nil {
+		return 0, err
+	}
+	q := req.URL.Query()
+	q.Set("arg", "/ipfs/"+cid)
+	req.URL.RawQuery = q.Encode()
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %q via RPC: %w", cid, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to stat %q via RPC: %s", cid, statusErr(resp))
+	}
+	var res struct {
+		Size int64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, fmt.Errorf("failed to decode stat response for %q: %w", cid, err)
+	}
+	return res.Size, nil
+}
+
+func (c *Client) statGateway(ctx context.Context, cid string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.baseURL+"/ipfs/"+cid, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat %q via gateway: %w", cid, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to stat %q via gateway: %s", cid, statusErr(resp))
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("gateway returned no usable Content-Length for %q: %w", cid, err)
+	}
+	return size, nil
+}
+
+// Get returns a reader over length bytes of the blob identified by cid,
+// starting at offset off. When the Client was configured with
+// WithParallelFetch and length exceeds the configured chunk size, the range
+// is fetched as concurrent sub-range requests and reassembled in order.
+func (c *Client) Get(ctx context.Context, cid string, off, length int64) (io.ReadCloser, error) {
+	if c.parallelChunkSize > 0 && length > c.parallelChunkSize {
+		return c.getParallel(ctx, cid, off, length)
+	}
+	return c.get(ctx, cid, off, length)
+}
+
+func (c *Client) get(ctx context.Context, cid string, off, length int64) (io.ReadCloser, error) {
+	switch c.mode {
+	case ModeGateway:
+		return c.getGateway(ctx, cid, off, length)
+	default:
+		return c.getRPC(ctx, cid, off, length)
+	}
+}
+
+func (c *Client) getRPC(ctx context.Context, cid string, off, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v0/cat", nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("arg", cid)
+	q.Set("offset", strconv.FormatInt(off, 10))
+	q.Set("length", strconv.FormatInt(length, 10))
+	req.URL.RawQuery = q.Encode()
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cat %q via RPC: %w", cid, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to cat %q via RPC: %s", cid, statusErr(resp))
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) getGateway(ctx context.Context, cid string, off, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/ipfs/"+cid, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %q via gateway: %w", cid, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("failed to get %q via gateway: %s", cid, statusErr(resp))
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for k, vv := range c.header {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	return c.httpClient.Do(req)
+}
+
+func statusErr(resp *http.Response) string {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Sprintf("%s: %s", resp.Status, bufio.NewScanner(strings.NewReader(string(b))).Text())
+}
+
+// Pin pins cid on the IPFS node (recursive=false, since stargz-snapshotter
+// only ever needs the single object behind the CID kept around, not any
+// DAG reachable from it), preventing it from being garbage collected while
+// this client is still reading from it.
+func (c *Client) Pin(ctx context.Context, cid string) error {
+	return c.pinOp(ctx, "add", cid)
+}
+
+// Unpin removes a pin previously added with Pin. Unpinning a CID that was
+// never pinned (e.g. because pinning is best-effort and failed silently)
+// is not an error.
+func (c *Client) Unpin(ctx context.Context, cid string) error {
+	return c.pinOp(ctx, "rm", cid)
+}
+
+func (c *Client) pinOp(ctx context.Context, op, cid string) error {
+	if c.mode != ModeRPC {
+		return fmt.Errorf("pinning requires RPC mode, got gateway mode")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v0/pin/"+op, nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Set("arg", "/ipfs/"+cid)
+	q.Set("recursive", "false")
+	req.URL.RawQuery = q.Encode()
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("failed to pin/%s %q: %w", op, cid, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var apiErr struct {
+		Message string
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	json.Unmarshal(body, &apiErr)
+	if op == "rm" && strings.Contains(strings.ToLower(apiErr.Message), "not pinned") {
+		// Nothing pinned to begin with is not a failure worth surfacing.
+		return nil
+	}
+	if apiErr.Message != "" {
+		return fmt.Errorf("failed to pin/%s %q: %s: %s", op, cid, resp.Status, apiErr.Message)
+	}
+	return fmt.Errorf("failed to pin/%s %q: %s", op, cid, resp.Status)
+}
+
+// GetCID extracts the CID that desc refers to. CIDs are carried on
+// descriptors as URLs of the form "ipfs://<cid>".
+func GetCID(desc ocispec.Descriptor) (string, error) {
+	for _, u := range desc.URLs {
+		if strings.HasPrefix(u, cidURLScheme) {
+			return strings.TrimPrefix(u, cidURLScheme), nil
+		}
+	}
+	return "", fmt.Errorf("no %s URL found on descriptor %s", cidURLScheme, desc.Digest)
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// chunkResult is the outcome of fetching one sub-range: either the bytes of
+// the chunk or the error that occurred while fetching it.
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+// getParallel splits [off, off+length) into sub-ranges of at most
+// c.parallelChunkSize bytes and fetches them concurrently, bounded by
+// c.parallelConcurrency in-flight sub-fetches at a time. The returned
+// io.ReadCloser yields the bytes in strictly sequential order; closing it
+// early cancels any sub-fetches still in flight.
+func (c *Client) getParallel(ctx context.Context, cid string, off, length int64) (io.ReadCloser, error) {
+	concurrency := c.parallelConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	type chunk struct {
+		off, length int64
+	}
+	var chunks []chunk
+	for o := off; o < off+length; o += c.parallelChunkSize {
+		l := c.parallelChunkSize
+		if o+l > off+length {
+			l = off + length - o
+		}
+		chunks = append(chunks, chunk{o, l})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	results := make([]chan chunkResult, len(chunks))
+	for i := range results {
+		results[i] = make(chan chunkResult, 1)
+	}
+
+	// Launching the sub-fetches must not block the caller: with a bounded
+	// sem, sending on it for chunk N+concurrency blocks until chunk N's
+	// goroutine exits, which would otherwise make this function wait for
+	// most of the range to finish before it could even return the reader.
+	// Doing the launching itself in a goroutine lets getParallel hand back
+	// the reader immediately, with fetching and reassembly proceeding
+	// fully in the background.
+	sem := make(chan struct{}, concurrency)
+	go func() {
+		for i, ch := range chunks {
+			i, ch := i, ch
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				defer func() { <-sem }()
+				data, err := c.fetchChunk(ctx, cid, ch.off, ch.length)
+				results[i] <- chunkResult{data: data, err: err}
+			}()
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer cancel()
+		for i, r := range results {
+			select {
+			case res := <-r:
+				if res.err != nil {
+					pw.CloseWithError(fmt.Errorf("failed to fetch chunk %d of %q: %w", i, cid, res.err))
+					return
+				}
+				if _, err := pw.Write(res.data); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				pw.CloseWithError(ctx.Err())
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	return &cancelOnCloseReader{ReadCloser: pr, cancel: cancel}, nil
+}
+
+func (c *Client) fetchChunk(ctx context.Context, cid string, off, length int64) ([]byte, error) {
+	rc, err := c.get(ctx, cid, off, length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// cancelOnCloseReader cancels the in-flight parallel fetch as soon as the
+// consumer closes the reader early, rather than draining it to completion.
+type cancelOnCloseReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnCloseReader) Close() error {
+	r.cancel()
+	return r.ReadCloser.Close()
+}
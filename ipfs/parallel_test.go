@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// patternByte deterministically derives the expected byte at a global blob
+// offset, independent of how it was chunked, so reassembly order can be
+// checked against a ground truth computed without any chunking at all.
+func patternByte(off int64) byte {
+	return byte(off % 251)
+}
+
+// newPatternServer serves /api/v0/cat requests with patternByte-filled
+// bytes for the requested offset/length, each response after the delay
+// given for its chunk index. It also records the offset of every request
+// it receives, so a test can count how many sub-range requests were made.
+func newPatternServer(t *testing.T, delays []time.Duration) (*httptest.Server, *[]int64) {
+	t.Helper()
+	var started []int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		off, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		length, _ := strconv.ParseInt(r.URL.Query().Get("length"), 10, 64)
+		started = append(started, off)
+		idx := int(off / length)
+		if idx < len(delays) {
+			time.Sleep(delays[idx])
+		}
+		buf := make([]byte, length)
+		for i := range buf {
+			buf[i] = patternByte(off + int64(i))
+		}
+		w.Write(buf)
+	}))
+	return srv, &started
+}
+
+func TestGetParallelReassemblesInOrder(t *testing.T) {
+	const chunkSize = 16
+	const numChunks = 5
+	const totalLen = chunkSize * numChunks
+
+	// Earlier chunks are slower than later ones, so with every chunk in
+	// flight at once the later chunks complete first; the output must still
+	// come back in offset order, with exactly one request per chunk.
+	delays := []time.Duration{30 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond, 5 * time.Millisecond, 0}
+	srv, started := newPatternServer(t, delays)
+	defer srv.Close()
+
+	c := NewClient(WithBaseURL(srv.URL), WithParallelFetch(chunkSize, numChunks))
+
+	rc, err := c.Get(context.Background(), "testcid", 0, totalLen)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != totalLen {
+		t.Fatalf("got %d bytes, want %d", len(got), totalLen)
+	}
+	for i, b := range got {
+		if want := patternByte(int64(i)); b != want {
+			t.Fatalf("byte %d = %x, want %x (reassembly out of order)", i, b, want)
+		}
+	}
+	if len(*started) != numChunks {
+		t.Fatalf("server observed %d chunk requests, want %d", len(*started), numChunks)
+	}
+}
+
+func TestGetParallelCancelOnEarlyClose(t *testing.T) {
+	const chunkSize = 16
+	const numChunks = 4
+	const totalLen = chunkSize * numChunks
+
+	block := make(chan struct{})
+	arrived := make(chan struct{}, numChunks)
+	canceled := make(chan struct{}, numChunks)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		select {
+		case <-block:
+			w.Write(make([]byte, chunkSize))
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		}
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	c := NewClient(WithBaseURL(srv.URL), WithParallelFetch(chunkSize, numChunks))
+	rc, err := c.Get(context.Background(), "testcid", 0, totalLen)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	for i := 0; i < numChunks; i++ {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d sub-fetches reached the server", i, numChunks)
+		}
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for i := 0; i < numChunks; i++ {
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d in-flight sub-fetches were canceled after an early Close", i, numChunks)
+		}
+	}
+}